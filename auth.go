@@ -0,0 +1,198 @@
+/*
+Copyright 2017 D2L Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/hashicorp/vault/api"
+)
+
+// AuthMethod logs in against Vault and returns the raw auth secret, leaving
+// lease bookkeeping and response-unwrapping to the caller.
+type AuthMethod interface {
+	Login(ctx context.Context) (*api.Secret, error)
+}
+
+func new_vault_client() (*api.Client, error) {
+	apiConfig := api.DefaultConfig()
+	apiConfig.Address = config.VaultUrl.String()
+
+	if err := apiConfig.ReadEnvironment(); err != nil {
+		return nil, err
+	}
+
+	client, err := api.NewClient(apiConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.WrapTtl != "" {
+		loginPath := auth_login_path()
+		client.SetWrappingLookupFunc(func(operation, path string) string {
+			if operation == http.MethodPut && path == loginPath {
+				return config.WrapTtl
+			}
+			return ""
+		})
+	}
+
+	return client, nil
+}
+
+// auth_login_path is the auth/<mount>/login path the active -auth-method
+// logs in against, used to scope response wrapping to just that request -
+// matching it against every PUT/POST the client issues would also wrap the
+// Unwrap call itself, never returning a token.
+func auth_login_path() string {
+	if config.AuthMethod == "approle" {
+		return fmt.Sprintf("auth/%s/login", config.ApproleMount)
+	}
+	return fmt.Sprintf("auth/%s/login", config.AwsMount)
+}
+
+func new_auth_method() (AuthMethod, error) {
+	switch config.AuthMethod {
+	case "aws-ec2":
+		return &Ec2AuthMethod{Mount: config.AwsMount, Role: config.Role}, nil
+	case "aws":
+		return &AwsIamAuthMethod{Mount: config.AwsMount, Role: config.Role}, nil
+	case "approle":
+		secretId, err := read_secret_id(config.SecretIdFile)
+		if err != nil {
+			return nil, err
+		}
+		return &ApproleAuthMethod{Mount: config.ApproleMount, RoleId: config.RoleId, SecretId: secretId}, nil
+	default:
+		return nil, fmt.Errorf("unknown -auth-method %q (expected aws-ec2, aws, or approle)", config.AuthMethod)
+	}
+}
+
+func read_secret_id(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("-secret-id-file is required when -auth-method=approle")
+	}
+
+	secretId, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(secretId)), nil
+}
+
+// Ec2AuthMethod is the original PKCS7 instance-identity login flow against
+// the aws-ec2 auth backend.
+type Ec2AuthMethod struct {
+	Mount string
+	Role  string
+}
+
+func (a *Ec2AuthMethod) Login(ctx context.Context) (*api.Secret, error) {
+	pkcs7, err := get_pkcs7()
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string]interface{}{
+		"role":  a.Role,
+		"pkcs7": string(pkcs7),
+	}
+
+	if nonceExists, nonce := get_nonce(); nonceExists {
+		data["nonce"] = nonce
+	}
+
+	return vaultClient.Logical().WriteWithContext(ctx, fmt.Sprintf("auth/%s/login", a.Mount), data)
+}
+
+// AwsIamAuthMethod authenticates against Vault's aws auth backend iam
+// method by presigning an sts:GetCallerIdentity request with whatever
+// credentials the aws-sdk-go default chain finds (instance profile, task
+// role, env vars, ...). Unlike Ec2AuthMethod, it needs no instance-identity
+// document, so it also works on Fargate and EKS IRSA.
+type AwsIamAuthMethod struct {
+	Mount string
+	Role  string
+}
+
+const stsRequestBody = "Action=GetCallerIdentity&Version=2011-06-15"
+
+func (a *AwsIamAuthMethod) Login(ctx context.Context) (*api.Secret, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	creds := sess.Config.Credentials
+	region := "us-east-1"
+	if sess.Config.Region != nil && *sess.Config.Region != "" {
+		region = *sess.Config.Region
+	}
+
+	stsRequest, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("https://sts.%s.amazonaws.com/", region), strings.NewReader(stsRequestBody))
+	if err != nil {
+		return nil, err
+	}
+	stsRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	signer := v4.NewSigner(creds)
+	if _, err := signer.Sign(stsRequest, strings.NewReader(stsRequestBody), "sts", region, time.Now()); err != nil {
+		return nil, err
+	}
+
+	headers, err := json.Marshal(stsRequest.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string]interface{}{
+		"role":                    a.Role,
+		"iam_http_request_method": stsRequest.Method,
+		"iam_request_url":         base64.StdEncoding.EncodeToString([]byte(stsRequest.URL.String())),
+		"iam_request_headers":     base64.StdEncoding.EncodeToString(headers),
+		"iam_request_body":        base64.StdEncoding.EncodeToString([]byte(stsRequestBody)),
+	}
+
+	return vaultClient.Logical().WriteWithContext(ctx, fmt.Sprintf("auth/%s/login", a.Mount), data)
+}
+
+// ApproleAuthMethod authenticates with a static role_id/secret_id pair,
+// for hosts where no AWS credentials are available at all.
+type ApproleAuthMethod struct {
+	Mount    string
+	RoleId   string
+	SecretId string
+}
+
+func (a *ApproleAuthMethod) Login(ctx context.Context) (*api.Secret, error) {
+	data := map[string]interface{}{
+		"role_id":   a.RoleId,
+		"secret_id": a.SecretId,
+	}
+
+	return vaultClient.Logical().WriteWithContext(ctx, fmt.Sprintf("auth/%s/login", a.Mount), data)
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2017 D2L Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const cacheRecordVersion = 1
+
+// CacheRecord is the on-disk representation of the current login, written
+// atomically to CachePath so an agent restart can skip re-authenticating
+// against a still-valid lease.
+type CacheRecord struct {
+	Version       int           `json:"version"`
+	Token         string        `json:"token"`
+	Accessor      string        `json:"accessor"`
+	LeaseEnd      time.Time     `json:"lease_end"`
+	Nonce         string        `json:"nonce"`
+	Renewable     bool          `json:"renewable"`
+	RoleTagMaxTtl time.Duration `json:"role_tag_max_ttl"`
+}
+
+// write_cache persists result as the current cache record: marshaled,
+// optionally encrypted, written to a temp file in the same directory, then
+// renamed into place so readers never observe a partial write.
+func write_cache(result *LoginResult) error {
+	record := CacheRecord{
+		Version:       cacheRecordVersion,
+		Token:         result.Token,
+		Accessor:      result.Accessor,
+		LeaseEnd:      result.LeaseEndTime,
+		Nonce:         result.Nonce,
+		Renewable:     result.Renewable,
+		RoleTagMaxTtl: result.RoleTagMaxTtl,
+	}
+
+	plaintext, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	key, err := cache_encryption_key()
+	if err != nil {
+		return err
+	}
+
+	payload := plaintext
+	if key != nil {
+		payload, err = encrypt_cache_record(key, plaintext)
+		if err != nil {
+			return err
+		}
+	}
+
+	dir := filepath.Dir(config.CachePath)
+	tmp, err := ioutil.TempFile(dir, ".vault-ec2auth-cache-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(payload); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), config.CachePath); err != nil {
+		return err
+	}
+
+	return fsync_dir(dir)
+}
+
+func fsync_dir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// load_cached_login reads CachePath and, if its token is still within its
+// lease and passes a lookup-self against the live Vault server, returns it
+// as a LoginResult ready to hand to finish_login.
+func load_cached_login() (*LoginResult, bool) {
+	payload, err := ioutil.ReadFile(config.CachePath)
+	if err != nil {
+		return nil, false
+	}
+
+	key, err := cache_encryption_key()
+	if err != nil {
+		return nil, false
+	}
+
+	if key != nil {
+		payload, err = decrypt_cache_record(key, payload)
+		if err != nil {
+			return nil, false
+		}
+	}
+
+	record := CacheRecord{}
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return nil, false
+	}
+
+	if !record.LeaseEnd.After(time.Now()) {
+		return nil, false
+	}
+
+	vaultClient.SetToken(record.Token)
+	if _, err := vaultClient.Auth().Token().LookupSelf(); err != nil {
+		return nil, false
+	}
+
+	return &LoginResult{
+		LeaseEndTime:  record.LeaseEnd,
+		Token:         record.Token,
+		Accessor:      record.Accessor,
+		Nonce:         record.Nonce,
+		Renewable:     record.Renewable,
+		RoleTagMaxTtl: record.RoleTagMaxTtl,
+	}, true
+}
+
+// cache_encryption_key derives the key the cache record is encrypted with,
+// from -cache-key-file if given, otherwise from the instance identity
+// document. An explicitly configured -cache-key-file that can't be read is
+// a hard error: we refuse to silently fall back to writing the token in
+// the clear. With no -cache-key-file, the instance-identity document is
+// only available under -auth-method=aws-ec2; aws and approle are the
+// methods chunk0-3 added specifically for hosts with no IMDS (Fargate, EKS
+// IRSA), so fetching it there would just block every cache read/write on
+// an IMDS call that's never going to succeed. Both cases return a nil key
+// (meaning "cache unencrypted") along with a warning instead of an error.
+func cache_encryption_key() ([]byte, error) {
+	if config.CacheKeyFile != "" {
+		keyMaterial, err := ioutil.ReadFile(config.CacheKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading -cache-key-file: %w", err)
+		}
+		sum := sha256.Sum256(keyMaterial)
+		return sum[:], nil
+	}
+
+	if config.AuthMethod != "aws-ec2" {
+		log.Print("event=cache_unencrypted reason=\"no -cache-key-file configured and -auth-method has no instance-identity document; caching the token in the clear\"")
+		return nil, nil
+	}
+
+	pkcs7, err := get_pkcs7()
+	if err != nil {
+		log.Print("event=cache_unencrypted reason=\"no -cache-key-file and no instance-identity document available; caching the token in the clear\"")
+		return nil, nil
+	}
+
+	sum := sha256.Sum256(pkcs7)
+	return sum[:], nil
+}
+
+func encrypt_cache_record(key []byte, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func decrypt_cache_record(key []byte, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, fmt.Errorf("cache record is shorter than the GCM nonce")
+	}
+
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
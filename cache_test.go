@@ -0,0 +1,67 @@
+/*
+Copyright 2017 D2L Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestEncryptDecryptCacheRecordRoundTrip(t *testing.T) {
+	key := sha256.Sum256([]byte("test key material"))
+	plaintext := []byte(`{"version":1,"token":"s.abc123"}`)
+
+	ciphertext, err := encrypt_cache_record(key[:], plaintext)
+	if err != nil {
+		t.Fatalf("encrypt_cache_record() error = %v", err)
+	}
+	if bytes.Equal(ciphertext, plaintext) {
+		t.Fatal("encrypt_cache_record() returned plaintext unchanged")
+	}
+
+	got, err := decrypt_cache_record(key[:], ciphertext)
+	if err != nil {
+		t.Fatalf("decrypt_cache_record() error = %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("decrypt_cache_record() = %q, want %q", got, plaintext)
+	}
+}
+
+func TestDecryptCacheRecordWrongKeyFails(t *testing.T) {
+	key := sha256.Sum256([]byte("correct key"))
+	wrongKey := sha256.Sum256([]byte("wrong key"))
+	plaintext := []byte("top secret vault token")
+
+	ciphertext, err := encrypt_cache_record(key[:], plaintext)
+	if err != nil {
+		t.Fatalf("encrypt_cache_record() error = %v", err)
+	}
+
+	if _, err := decrypt_cache_record(wrongKey[:], ciphertext); err == nil {
+		t.Fatal("decrypt_cache_record() error = nil, want an error with the wrong key")
+	}
+}
+
+func TestDecryptCacheRecordTruncatedFails(t *testing.T) {
+	key := sha256.Sum256([]byte("test key material"))
+
+	if _, err := decrypt_cache_record(key[:], []byte("short")); err == nil {
+		t.Fatal("decrypt_cache_record() error = nil, want an error on a too-short record")
+	}
+}
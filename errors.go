@@ -0,0 +1,99 @@
+/*
+Copyright 2017 D2L Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// RecoverableError wraps an error that is expected to clear up on its own -
+// a network blip, a busy Vault node, a slow IMDS - and is worth retrying
+// instead of killing the agent outright.
+type RecoverableError struct {
+	Err error
+}
+
+func (e *RecoverableError) Error() string { return e.Err.Error() }
+func (e *RecoverableError) Unwrap() error { return e.Err }
+
+func is_recoverable(err error) bool {
+	var recoverable *RecoverableError
+	return errors.As(err, &recoverable)
+}
+
+// classify_error decides whether err is worth retrying. Vault 429 (rate
+// limited) and 5xx, and any plain network/DNS/timeout error, are
+// recoverable; everything else - a rejected login, permission denied, a
+// malformed pkcs7 document - is terminal and passed through unwrapped.
+func classify_error(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var responseErr *api.ResponseError
+	if errors.As(err, &responseErr) {
+		if responseErr.StatusCode == 429 || responseErr.StatusCode >= 500 {
+			return &RecoverableError{Err: err}
+		}
+		return err
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return &RecoverableError{Err: err}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return &RecoverableError{Err: err}
+	}
+
+	return err
+}
+
+// backoff hands out exponentially increasing, jittered delays, capped so a
+// long Vault outage doesn't leave the agent sleeping for hours between
+// attempts.
+type backoff struct {
+	attempt int
+}
+
+const maxBackoffDelay = 5 * time.Minute
+
+func new_backoff() *backoff {
+	return &backoff{}
+}
+
+func (b *backoff) next() time.Duration {
+	delay := time.Duration(config.RetryDelay) * time.Second
+	if b.attempt < 6 {
+		delay = delay << uint(b.attempt)
+	} else {
+		delay = maxBackoffDelay
+	}
+	if delay > maxBackoffDelay {
+		delay = maxBackoffDelay
+	}
+	b.attempt++
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
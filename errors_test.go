@@ -0,0 +1,60 @@
+/*
+Copyright 2017 D2L Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		name        string
+		err         error
+		recoverable bool
+	}{
+		{"nil", nil, false},
+		{"vault 429 rate limited", &api.ResponseError{StatusCode: 429}, true},
+		{"vault 500", &api.ResponseError{StatusCode: 500}, true},
+		{"vault 503", &api.ResponseError{StatusCode: 503}, true},
+		{"vault 403 permission denied", &api.ResponseError{StatusCode: 403}, false},
+		{"vault 400 bad request", &api.ResponseError{StatusCode: 400}, false},
+		{"dns error", &net.DNSError{Err: "no such host"}, true},
+		{"net error", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"plain error", errors.New("login returned no client token"), false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := classify_error(c.err)
+
+			if c.err == nil {
+				if got != nil {
+					t.Fatalf("classify_error(nil) = %v, want nil", got)
+				}
+				return
+			}
+
+			if is_recoverable(got) != c.recoverable {
+				t.Fatalf("is_recoverable(classify_error(%v)) = %v, want %v", c.err, is_recoverable(got), c.recoverable)
+			}
+		})
+	}
+}
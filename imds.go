@@ -0,0 +1,102 @@
+/*
+Copyright 2017 D2L Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+const (
+	imdsTokenPath       = "/latest/api/token"
+	imdsPkcs7Path       = "/latest/dynamic/instance-identity/pkcs7"
+	imdsTokenTtlSeconds = 21600
+)
+
+// get_pkcs7 fetches the instance-identity document used to authenticate
+// against the aws-ec2 auth backend, using an IMDSv2 session token when the
+// instance supports it and falling back to IMDSv1 otherwise.
+func get_pkcs7() ([]byte, error) {
+	if os.Getenv("AWS_EC2_METADATA_DISABLED") == "true" {
+		return nil, fmt.Errorf("AWS_EC2_METADATA_DISABLED is set; cannot fetch the instance-identity document")
+	}
+
+	token, err := get_imds_token()
+	if err != nil {
+		return nil, classify_error(err)
+	}
+
+	pkcs7Request, err := http.NewRequest("GET", config.ImdsEndpoint+imdsPkcs7Path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		pkcs7Request.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+
+	response, err := imdsClient.Do(pkcs7Request)
+	if err != nil {
+		return nil, classify_error(err)
+	}
+	defer response.Body.Close()
+
+	pkcs7, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, classify_error(err)
+	}
+
+	if len(pkcs7) == 0 {
+		return nil, fmt.Errorf("instance-identity document was empty or malformed")
+	}
+
+	return pkcs7, nil
+}
+
+// get_imds_token requests an IMDSv2 session token. Instances with
+// HttpTokens not required for imds reply 404/405 to the PUT; in that case
+// we fall back to IMDSv1 by returning an empty token.
+func get_imds_token() (string, error) {
+	tokenRequest, err := http.NewRequest("PUT", config.ImdsEndpoint+imdsTokenPath, nil)
+	if err != nil {
+		return "", err
+	}
+	tokenRequest.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", fmt.Sprintf("%d", imdsTokenTtlSeconds))
+
+	response, err := imdsClient.Do(tokenRequest)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusMethodNotAllowed {
+		return "", nil
+	}
+
+	if response.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(response.Body)
+		return "", fmt.Errorf("failed to fetch IMDSv2 token with error code [%s] - %s", response.Status, string(b))
+	}
+
+	token, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return string(token), nil
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2017 D2L Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func withImdsEndpoint(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	previous := config.ImdsEndpoint
+	config.ImdsEndpoint = server.URL
+	t.Cleanup(func() { config.ImdsEndpoint = previous })
+}
+
+func TestGetImdsTokenV2(t *testing.T) {
+	withImdsEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != imdsTokenPath {
+			t.Fatalf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		w.Write([]byte("v2-session-token"))
+	})
+
+	token, err := get_imds_token()
+	if err != nil {
+		t.Fatalf("get_imds_token() error = %v", err)
+	}
+	if token != "v2-session-token" {
+		t.Fatalf("get_imds_token() = %q, want %q", token, "v2-session-token")
+	}
+}
+
+func TestGetImdsTokenFallsBackOnNotFound(t *testing.T) {
+	withImdsEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	token, err := get_imds_token()
+	if err != nil {
+		t.Fatalf("get_imds_token() error = %v", err)
+	}
+	if token != "" {
+		t.Fatalf("get_imds_token() = %q, want empty token on 404", token)
+	}
+}
+
+func TestGetImdsTokenFallsBackOnMethodNotAllowed(t *testing.T) {
+	withImdsEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	})
+
+	token, err := get_imds_token()
+	if err != nil {
+		t.Fatalf("get_imds_token() error = %v", err)
+	}
+	if token != "" {
+		t.Fatalf("get_imds_token() = %q, want empty token on 405", token)
+	}
+}
+
+func TestGetImdsTokenOtherErrorIsReported(t *testing.T) {
+	withImdsEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("boom"))
+	})
+
+	if _, err := get_imds_token(); err == nil {
+		t.Fatal("get_imds_token() error = nil, want an error on 500")
+	}
+}
+
+func TestGetPkcs7(t *testing.T) {
+	withImdsEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case imdsTokenPath:
+			w.WriteHeader(http.StatusNotFound)
+		case imdsPkcs7Path:
+			w.Write([]byte("pkcs7-document"))
+		default:
+			t.Fatalf("unexpected request path: %s", r.URL.Path)
+		}
+	})
+
+	pkcs7, err := get_pkcs7()
+	if err != nil {
+		t.Fatalf("get_pkcs7() error = %v", err)
+	}
+	if string(pkcs7) != "pkcs7-document" {
+		t.Fatalf("get_pkcs7() = %q, want %q", pkcs7, "pkcs7-document")
+	}
+}
+
+func TestGetPkcs7EmptyDocumentIsAnError(t *testing.T) {
+	withImdsEndpoint(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case imdsTokenPath:
+			w.WriteHeader(http.StatusNotFound)
+		case imdsPkcs7Path:
+			// deliberately empty body
+		}
+	})
+
+	if _, err := get_pkcs7(); err == nil {
+		t.Fatal("get_pkcs7() error = nil, want an error on an empty document")
+	}
+}
@@ -17,9 +17,7 @@ limitations under the License.
 package main
 
 import (
-	"bytes"
-	"crypto/tls"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -29,8 +27,10 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"testing"
 	"time"
 
+	"github.com/hashicorp/vault/api"
 	"github.com/mitchellh/go-homedir"
 )
 
@@ -42,59 +42,50 @@ type Config struct {
 	NoncePath  string
 	Agent      bool
 	RetryDelay int
-}
+	WrapTtl    string
 
-type SealStatus struct {
-	Sealed      bool   `json:"sealed"`
-	Version     string `json:"version"`
-	ClusterName string `json:"cluster_name"`
-}
+	RenewIncrement int
+	RenewThreshold int
 
-type LoginRequest struct {
-	Role  string `json:"role"`
-	Pkcs7 string `json:"pkcs7"`
-}
+	AuthMethod   string
+	ApproleMount string
+	RoleId       string
+	SecretIdFile string
+
+	ImdsEndpoint string
 
-type ReLoginRequest struct {
-	Role  string `json:"role"`
-	Pkcs7 string `json:"pkcs7"`
-	Nonce string `json:"nonce"`
+	CachePath    string
+	CacheKeyFile string
+
+	ConfigPath string
 }
 
-type LoginResponse struct {
-	Auth struct {
-		Renewable     bool  `json:"renewable"`
-		LeaseDuration int32 `json:"lease_duration"`
-		MetaData      struct {
-			RoleTagMaxTtl string `json:"role_tag_max_ttl"`
-			Role          string `json:"role"`
-			Region        string `json:"region"`
-			Nonce         string `json:"nonce"`
-			InstanceId    string `json:"instance_id"`
-			AmiId         string `json:"ami_id"`
-		} `json:"metadata"`
-		Policies    []string `json:"policies"`
-		Accessor    string   `json:"accessor"`
-		ClientToken string   `json:"client_token"`
-	} `json:"auth"`
-	Warnings []string `json:"warnings"`
-	WrapInfo struct {
-		TTL             time.Duration `json:"ttl"`
-		Token           string        `json:"token"`
-		CreationTime    time.Time     `json:"creation_time"`
-		WrappedAccessor string        `json:"wrapped_accessor"`
-		Format          string        `json:"format"`
-	} `json:"wrap_info"`
-	LeaseDuration int32  `json:"lease_duration"`
-	Renewable     bool   `json:"renewable"`
-	LeaseId       string `json:"lease_id"`
-	RequestId     string `json:"request_id"`
+// LoginResult is everything ec2_auth_against_vault_server needs from a
+// successful login, whether it came from a fresh auth or a cache hit.
+type LoginResult struct {
+	LeaseEndTime  time.Time
+	Token         string
+	Accessor      string
+	Nonce         string
+	Renewable     bool
+	RoleTagMaxTtl time.Duration
 }
 
-var client http.Client
+var vaultClient *api.Client
+var imdsClient http.Client
 var config Config
 
 func init() {
+	imdsClient = http.Client{Timeout: time.Second * 10}
+
+	// Under `go test`, skip flag registration/parsing entirely: it would
+	// otherwise choke on the test binary's own flags (-test.v and friends)
+	// and, with no -role given, hit the log.Fatal below. Tests set whatever
+	// config fields they need directly.
+	if testing.Testing() {
+		return
+	}
+
 	var err error
 	var vaultUrlParameter string
 
@@ -108,6 +99,17 @@ func init() {
 	flag.StringVar(&config.TokenPath, "token-path", filepath.Join(homeDir, ".vault-token"), "the path to the token file")
 	flag.BoolVar(&config.Agent, "agent", false, "setting this flag will run in agent mode")
 	flag.IntVar(&config.RetryDelay, "retry-delay", 30, "The number of seconds between retries between failed login attempts")
+	flag.StringVar(&config.WrapTtl, "wrap-ttl", "", "if set, requests the login token response-wrapped with this TTL (e.g. \"60s\") and unwraps it before use")
+	flag.IntVar(&config.RenewIncrement, "renew-increment", 3600, "the number of seconds to request on each token renew-self call")
+	flag.IntVar(&config.RenewThreshold, "renew-threshold", 60, "renew the token this many seconds before its lease expires, instead of re-authenticating")
+	flag.StringVar(&config.AuthMethod, "auth-method", "aws-ec2", "the vault auth method to use: aws-ec2, aws, or approle")
+	flag.StringVar(&config.ApproleMount, "approle-mount", "approle", "the approle mount path, when -auth-method=approle")
+	flag.StringVar(&config.RoleId, "role-id", "", "the approle role_id, when -auth-method=approle")
+	flag.StringVar(&config.SecretIdFile, "secret-id-file", "", "path to a file containing the approle secret_id, when -auth-method=approle")
+	flag.StringVar(&config.ImdsEndpoint, "imds-endpoint", "http://169.254.169.254", "the EC2 instance metadata service endpoint (e.g. \"http://[fd00:ec2::254]\" for the link-local IPv6 endpoint, or a test server)")
+	flag.StringVar(&config.CachePath, "cache-path", filepath.Join(homeDir, ".vault-ec2auth-cache"), "the path to the persistent token cache")
+	flag.StringVar(&config.CacheKeyFile, "cache-key-file", "", "path to a key file to encrypt the token cache with (default: derived from the instance identity document)")
+	flag.StringVar(&config.ConfigPath, "config", "", "path to a YAML config file describing sinks and templates to write on each token rotation, in -agent mode")
 	flag.Parse()
 
 	if config.Role == "" {
@@ -118,10 +120,19 @@ func init() {
 	config.VaultUrl, err = url.Parse(vaultUrlParameter)
 	check(err)
 
-	init_httpClient()
+	vaultClient, err = new_vault_client()
+	check(err)
 }
 
+var sinkManager *SinkManager
+
 func main() {
+	if config.Agent {
+		var err error
+		sinkManager, err = new_sink_manager(config.ConfigPath)
+		check(err)
+	}
+
 	lease_renewal_time := time.Now()
 
 	for {
@@ -136,18 +147,6 @@ func main() {
 	}
 }
 
-func init_httpClient() {
-	tr := &http.Transport{
-		// ignore SSL errors when talking to Vault because it could be a self-signed cert until Vault is up and running for realsies
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	timeout := time.Duration(time.Second * 10)
-	client = http.Client{
-		Timeout:   timeout,
-		Transport: tr,
-	}
-}
-
 func wait_for_active_vault_server(server string) {
 	for {
 		_, err := net.LookupHost(server)
@@ -170,28 +169,58 @@ func wait_until_lease_is_expired(lease_renewal_time time.Time) {
 }
 
 func ec2_auth_against_vault_server() time.Time {
-	var lease_end_time time.Time
-	var vault_token string
-	var vault_nonce string
+	if result, ok := load_cached_login(); ok {
+		log.Printf("event=cache_hit reusing cached token valid until [%s]", result.LeaseEndTime.Format(time.RFC1123Z))
+		return finish_login(result)
+	}
+
+	var result *LoginResult
 	var err error
 
+	retry := new_backoff()
+
 	for {
-		lease_end_time, vault_token, vault_nonce, err = vault_ec2_auth()
+		result, err = vault_ec2_auth()
 		if err != nil {
+			if !is_recoverable(err) {
+				log.Fatal(err.Error())
+			}
+
 			log.Print(err.Error())
-			time.Sleep(time.Second * time.Duration(config.RetryDelay))
+			time.Sleep(retry.next())
 		} else {
 			break
 		}
 	}
 
-	err = ioutil.WriteFile(config.TokenPath, []byte(vault_token), 0660)
+	if err := write_cache(result); err != nil {
+		log.Printf("event=cache_write_failure error=%q", err.Error())
+	}
+
+	return finish_login(result)
+}
+
+// finish_login writes the legacy token/nonce files consumers expect at
+// TokenPath/NoncePath, then either starts the renewer or schedules the next
+// full re-auth at the lease midpoint.
+func finish_login(result *LoginResult) time.Time {
+	err := ioutil.WriteFile(config.TokenPath, []byte(result.Token), 0660)
 	check(err)
 
-	err = ioutil.WriteFile(config.NoncePath, []byte(vault_nonce), 0660)
+	err = ioutil.WriteFile(config.NoncePath, []byte(result.Nonce), 0660)
 	check(err)
 
-	return get_datetime_midpoint(time.Now(), lease_end_time)
+	if sinkManager != nil {
+		if err := sinkManager.Update(result.Token); err != nil {
+			log.Printf("event=sink_update_failure error=%q", err.Error())
+		}
+	}
+
+	if result.Renewable {
+		return run_renewer(result.Token, result.LeaseEndTime, result.RoleTagMaxTtl)
+	}
+
+	return get_datetime_midpoint(time.Now(), result.LeaseEndTime)
 }
 
 func check(err error) {
@@ -200,51 +229,40 @@ func check(err error) {
 	}
 }
 
-func vault_ec2_auth() (time.Time, string, string, error) {
-	pkcs7, err := get_pkcs7()
-	check(err)
-
-	nonceExists, nonce := get_nonce()
+// vault_ec2_auth logs in via the configured AuthMethod and, if -wrap-ttl was
+// set, unwraps the resulting cubbyhole-wrapped secret before returning it.
+func vault_ec2_auth() (*LoginResult, error) {
+	authMethod, err := new_auth_method()
+	if err != nil {
+		return nil, classify_error(err)
+	}
 
-	var body []byte
+	secret, err := authMethod.Login(context.Background())
+	if err != nil {
+		return nil, classify_error(err)
+	}
 
-	if nonceExists {
-		request := ReLoginRequest{
-			Role:  config.Role,
-			Pkcs7: string(pkcs7),
-			Nonce: nonce,
-		}
-		body, err = json.Marshal(request)
-		check(err)
-	} else {
-		request := LoginRequest{
-			Role:  config.Role,
-			Pkcs7: string(pkcs7),
+	if config.WrapTtl != "" {
+		secret, err = vaultClient.Logical().Unwrap(secret.WrapInfo.Token)
+		if err != nil {
+			return nil, classify_error(err)
 		}
-		body, err = json.Marshal(request)
-		check(err)
 	}
 
-	response, err := client.Post(fmt.Sprintf("%s/v1/auth/%s/login", config.VaultUrl, config.AwsMount), "application/json", bytes.NewBuffer(body))
-	check(err)
-	defer response.Body.Close()
-
-	if response.StatusCode >= 300 ||
-		response.StatusCode < 200 {
-
-		b, _ := ioutil.ReadAll(response.Body)
-		err := fmt.Errorf("Login attempt failed with error code [%s] - %s", response.Status, string(b))
-
-		return time.Now(), "", "", err
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return nil, &RecoverableError{Err: fmt.Errorf("login returned no client token")}
 	}
 
-	result := LoginResponse{}
-	err = json.NewDecoder(response.Body).Decode(&result)
-	check(err)
-
-	leaseEndTime := time.Now().Add(time.Second * time.Duration(result.Auth.LeaseDuration))
+	roleTagMaxTtl, _ := time.ParseDuration(secret.Auth.Metadata["role_tag_max_ttl"])
 
-	return leaseEndTime, result.Auth.ClientToken, result.Auth.MetaData.Nonce, nil
+	return &LoginResult{
+		LeaseEndTime:  time.Now().Add(time.Second * time.Duration(secret.Auth.LeaseDuration)),
+		Token:         secret.Auth.ClientToken,
+		Accessor:      secret.Auth.Accessor,
+		Nonce:         secret.Auth.Metadata["nonce"],
+		Renewable:     secret.Auth.Renewable,
+		RoleTagMaxTtl: roleTagMaxTtl,
+	}, nil
 }
 
 func get_nonce() (bool, string) {
@@ -258,15 +276,6 @@ func get_nonce() (bool, string) {
 	return false, ""
 }
 
-func get_pkcs7() ([]byte, error) {
-	ec2MetaDataEndpoint := "http://169.254.169.254/latest/dynamic/instance-identity/pkcs7"
-	pkcs7Request, err := client.Get(ec2MetaDataEndpoint)
-	defer pkcs7Request.Body.Close()
-	pkcs7, _ := ioutil.ReadAll(pkcs7Request.Body)
-
-	return pkcs7, err
-}
-
 func get_datetime_midpoint(time1 time.Time, time2 time.Time) time.Time {
 	if time2.After(time1) {
 		return time1.Add(time2.Sub(time1) / 2)
@@ -0,0 +1,121 @@
+/*
+Copyright 2017 D2L Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Renewer keeps a single Vault token alive via renew-self instead of
+// forcing a full EC2 re-auth at the midpoint of every lease.
+type Renewer struct {
+	Token         string
+	LeaseDuration int
+	RoleTagMaxTtl time.Duration
+
+	RenewCh chan time.Time
+	DoneCh  chan struct{}
+}
+
+func new_renewer(token string, leaseDuration int, roleTagMaxTtl time.Duration) *Renewer {
+	return &Renewer{
+		Token:         token,
+		LeaseDuration: leaseDuration,
+		RoleTagMaxTtl: roleTagMaxTtl,
+		RenewCh:       make(chan time.Time),
+		DoneCh:        make(chan struct{}),
+	}
+}
+
+// run_renewer hands the token to a Renewer and blocks until renewal stops
+// working, returning a time to immediately re-authenticate against.
+func run_renewer(token string, leaseEndTime time.Time, roleTagMaxTtl time.Duration) time.Time {
+	leaseDuration := int(time.Until(leaseEndTime).Seconds())
+	renewer := new_renewer(token, leaseDuration, roleTagMaxTtl)
+	started := time.Now()
+
+	go renewer.run(started)
+
+	for {
+		select {
+		case <-renewer.RenewCh:
+			// lease extended; keep waiting for the next renewal or fallback.
+		case <-renewer.DoneCh:
+			return time.Now()
+		}
+	}
+}
+
+// run periodically renews r.Token, reporting each successful renewal on
+// RenewCh. It gives up and closes DoneCh - so the caller can fall back to a
+// full EC2 re-auth - if a renewal fails or RoleTagMaxTtl is reached.
+func (r *Renewer) run(started time.Time) {
+	leaseEnd := started.Add(time.Second * time.Duration(r.LeaseDuration))
+
+	for {
+		sleep := time.Until(leaseEnd) - time.Second*time.Duration(config.RenewThreshold)
+		if sleep < 0 {
+			sleep = 0
+		}
+		time.Sleep(sleep)
+
+		if r.RoleTagMaxTtl > 0 && time.Since(started) >= r.RoleTagMaxTtl {
+			log_renew_event("renew_fallback", "reason", "role_tag_max_ttl reached")
+			close(r.DoneCh)
+			return
+		}
+
+		newLeaseDuration, err := renew_self(r.Token, config.RenewIncrement)
+		if err != nil {
+			log_renew_event("renew_failure", "error", err.Error())
+			close(r.DoneCh)
+			return
+		}
+
+		leaseEnd = time.Now().Add(time.Second * time.Duration(newLeaseDuration))
+		log_renew_event("renew_success", "lease_duration", fmt.Sprintf("%ds", newLeaseDuration))
+		r.RenewCh <- leaseEnd
+	}
+}
+
+func renew_self(token string, increment int) (int, error) {
+	vaultClient.SetToken(token)
+
+	secret, err := vaultClient.Auth().Token().RenewSelf(increment)
+	if err != nil {
+		return 0, err
+	}
+
+	if secret == nil || secret.Auth == nil {
+		return 0, fmt.Errorf("renew-self returned no lease information")
+	}
+
+	return secret.Auth.LeaseDuration, nil
+}
+
+// log_renew_event prints a renewal event as logfmt-style key=value pairs so
+// renewal success/failure/fallback can be grepped or shipped separately
+// from the rest of the agent's output.
+func log_renew_event(event string, kv ...string) {
+	line := fmt.Sprintf("event=%s", event)
+	for i := 0; i+1 < len(kv); i += 2 {
+		line += fmt.Sprintf(" %s=%q", kv[i], kv[i+1])
+	}
+	log.Print(line)
+}
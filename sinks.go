@@ -0,0 +1,271 @@
+/*
+Copyright 2017 D2L Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// SinkFileConfig is the YAML shape of one entry under "sinks:" in -config.
+// Type selects which of file/socket/exec is built from the rest of the
+// fields.
+type SinkFileConfig struct {
+	Type    string   `yaml:"type"`
+	Path    string   `yaml:"path"`
+	Mode    uint32   `yaml:"mode"`
+	Uid     int      `yaml:"uid"`
+	Gid     int      `yaml:"gid"`
+	Command []string `yaml:"command"`
+}
+
+type TemplateFileConfig struct {
+	Source      string `yaml:"source"`
+	Destination string `yaml:"destination"`
+	Path        string `yaml:"path"`
+}
+
+type SinkFile struct {
+	Sinks     []SinkFileConfig     `yaml:"sinks"`
+	Templates []TemplateFileConfig `yaml:"templates"`
+}
+
+// Sink writes the current Vault token somewhere whenever it rotates.
+type Sink interface {
+	Update(token string) error
+}
+
+// SinkManager fans a token rotation out to every configured sink and
+// re-renders every configured template.
+type SinkManager struct {
+	sinks     []Sink
+	templates []*TemplateSink
+}
+
+func new_sink_manager(configPath string) (*SinkManager, error) {
+	if configPath == "" {
+		return &SinkManager{}, nil
+	}
+
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	sinkFile := SinkFile{}
+	if err := yaml.Unmarshal(data, &sinkFile); err != nil {
+		return nil, err
+	}
+
+	manager := &SinkManager{}
+
+	for _, sinkConfig := range sinkFile.Sinks {
+		sink, err := new_sink(sinkConfig)
+		if err != nil {
+			return nil, err
+		}
+		manager.sinks = append(manager.sinks, sink)
+	}
+
+	for _, templateConfig := range sinkFile.Templates {
+		manager.templates = append(manager.templates, &TemplateSink{
+			Source:      templateConfig.Source,
+			Destination: templateConfig.Destination,
+			SecretPath:  templateConfig.Path,
+		})
+	}
+
+	return manager, nil
+}
+
+func new_sink(sinkConfig SinkFileConfig) (Sink, error) {
+	switch sinkConfig.Type {
+	case "file":
+		mode := os.FileMode(sinkConfig.Mode)
+		if mode == 0 {
+			mode = 0600
+		}
+		return &FileSink{Path: sinkConfig.Path, Mode: mode, Uid: sinkConfig.Uid, Gid: sinkConfig.Gid}, nil
+	case "socket":
+		return &SocketSink{Path: sinkConfig.Path}, nil
+	case "exec":
+		if len(sinkConfig.Command) == 0 {
+			return nil, fmt.Errorf("sink of type \"exec\" requires a non-empty command")
+		}
+		return &ExecSink{Command: sinkConfig.Command}, nil
+	default:
+		return nil, fmt.Errorf("unknown sink type %q (expected file, socket, or exec)", sinkConfig.Type)
+	}
+}
+
+func (m *SinkManager) Update(token string) error {
+	for _, sink := range m.sinks {
+		if err := sink.Update(token); err != nil {
+			return err
+		}
+	}
+
+	for _, tmpl := range m.templates {
+		if err := tmpl.Render(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FileSink writes the token to a file with a configurable mode/uid/gid, so
+// a downstream app can read it without talking to Vault itself.
+type FileSink struct {
+	Path string
+	Mode os.FileMode
+	Uid  int
+	Gid  int
+}
+
+func (s *FileSink) Update(token string) error {
+	if err := ioutil.WriteFile(s.Path, []byte(token), s.Mode); err != nil {
+		return err
+	}
+
+	if s.Uid != 0 || s.Gid != 0 {
+		return os.Chown(s.Path, s.Uid, s.Gid)
+	}
+
+	return nil
+}
+
+// SocketSink serves the current token over a minimal HTTP endpoint on a
+// Unix domain socket, so a downstream app can fetch it on demand instead of
+// polling a file.
+type SocketSink struct {
+	Path string
+
+	mu       sync.RWMutex
+	token    string
+	listener net.Listener
+}
+
+func (s *SocketSink) Update(token string) error {
+	s.mu.Lock()
+	s.token = token
+	s.mu.Unlock()
+
+	if s.listener != nil {
+		return nil
+	}
+
+	os.Remove(s.Path)
+
+	listener, err := net.Listen("unix", s.Path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(s.Path, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	s.listener = listener
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/token", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		w.Write([]byte(s.token))
+	})
+
+	go http.Serve(listener, mux)
+
+	return nil
+}
+
+// ExecSink re-runs Command with VAULT_TOKEN set to the current token on the
+// first rotation, then signals the running process with SIGHUP on every
+// subsequent rotation instead of restarting it.
+type ExecSink struct {
+	Command []string
+
+	cmd *exec.Cmd
+}
+
+func (s *ExecSink) Update(token string) error {
+	if s.cmd != nil && s.cmd.Process != nil {
+		return s.cmd.Process.Signal(syscall.SIGHUP)
+	}
+
+	cmd := exec.Command(s.Command[0], s.Command[1:]...)
+	cmd.Env = append(os.Environ(), "VAULT_TOKEN="+token)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	s.cmd = cmd
+
+	go cmd.Wait()
+
+	return nil
+}
+
+// TemplateSink renders a Go text/template against a secret read from
+// SecretPath and writes the result to Destination on every rotation.
+type TemplateSink struct {
+	Source      string
+	Destination string
+	SecretPath  string
+}
+
+func (t *TemplateSink) Render() error {
+	secret, err := vaultClient.Logical().Read(t.SecretPath)
+	if err != nil {
+		return err
+	}
+
+	var data map[string]interface{}
+	if secret != nil {
+		data = secret.Data
+	}
+
+	source, err := ioutil.ReadFile(t.Source)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := template.New(filepath.Base(t.Source)).Parse(string(source))
+	if err != nil {
+		return err
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(t.Destination, rendered.Bytes(), 0640)
+}